@@ -0,0 +1,282 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package problemclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/apis/certificates"
+	"k8s.io/kubernetes/pkg/client/restclient"
+	unversionedcertificates "k8s.io/kubernetes/pkg/client/typed/generated/certificates/unversioned"
+	"k8s.io/kubernetes/pkg/client/unversioned/clientcmd"
+)
+
+var (
+	bootstrapKubeconfig = flag.String("bootstrap-kubeconfig", "", "Path to a kubeconfig with credentials to a short-lived bootstrap token. If set, node problem detector provisions its own client certificate through the certificates.k8s.io CSR flow instead of using --kubeconfig/in-cluster credentials directly.")
+	certDir             = flag.String("cert-dir", "/var/lib/node-problem-detector/pki", "Directory in which the bootstrapped client key and certificate are persisted.")
+	certRenewalFraction = flag.Float64("cert-renewal-fraction", 0.2, "Renew the bootstrapped client certificate once this fraction of its validity period remains.")
+)
+
+const (
+	certFileName = "node-problem-detector-client.crt"
+	keyFileName  = "node-problem-detector-client.key"
+
+	csrPollInterval = 2 * time.Second
+	csrPollTimeout  = 5 * time.Minute
+)
+
+// certManager drives the kubelet-style TLS bootstrap: it exchanges a short-lived bootstrap
+// kubeconfig for a long-lived client certificate via the certificates.k8s.io CSR API, and keeps
+// that certificate renewed for as long as the process runs.
+type certManager struct {
+	baseCfg      restclient.Config
+	bootstrapCfg *restclient.Config
+	nodeName     string
+	certFile     string
+	keyFile      string
+}
+
+// maybeNewCertManager returns a certManager if --bootstrap-kubeconfig is set, or nil if the
+// bootstrap flow was not requested, in which case cfg should be used as-is. cfg may be nil, which
+// happens when the regular --kubeconfig/in-cluster config couldn't be resolved (e.g. a fresh node
+// that has nothing but the bootstrap token yet); in that case the base cluster info (host, CA) is
+// derived from the bootstrap kubeconfig itself, the same way kubelet bootstraps.
+func maybeNewCertManager(cfg *restclient.Config, nodeName string) (*certManager, error) {
+	if *bootstrapKubeconfig == "" {
+		return nil, nil
+	}
+	bootstrapCfg, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: *bootstrapKubeconfig},
+		&clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load bootstrap kubeconfig %q: %v", *bootstrapKubeconfig, err)
+	}
+	if cfg == nil {
+		cfg = &restclient.Config{
+			Host:     bootstrapCfg.Host,
+			Insecure: bootstrapCfg.Insecure,
+			TLSClientConfig: restclient.TLSClientConfig{
+				CAFile: bootstrapCfg.TLSClientConfig.CAFile,
+				CAData: bootstrapCfg.TLSClientConfig.CAData,
+			},
+		}
+	}
+	return &certManager{
+		baseCfg:      *cfg,
+		bootstrapCfg: bootstrapCfg,
+		nodeName:     nodeName,
+		certFile:     filepath.Join(*certDir, certFileName),
+		keyFile:      filepath.Join(*certDir, keyFileName),
+	}, nil
+}
+
+// bootstrap runs the CSR flow against the bootstrap credentials and returns a rest config for
+// baseCfg's apiserver, authenticated with the freshly issued client certificate. It gives up and
+// returns an error promptly if stopCh is closed while waiting for CSR approval, so callers (e.g.
+// Close()) aren't stuck waiting out csrPollTimeout.
+func (m *certManager) bootstrap(stopCh <-chan struct{}) (*restclient.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate client key: %v", err)
+	}
+	csrPEM, err := newCertificateRequest(key, m.nodeName)
+	if err != nil {
+		return nil, err
+	}
+
+	csrClient, err := unversionedcertificates.NewForConfig(m.bootstrapCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build CSR client: %v", err)
+	}
+	csr, err := csrClient.CertificateSigningRequests().Create(&certificates.CertificateSigningRequest{
+		ObjectMeta: api.ObjectMeta{GenerateName: "csr-" + m.nodeName + "-"},
+		Spec: certificates.CertificateSigningRequestSpec{
+			Request: csrPEM,
+			Usages: []certificates.KeyUsage{
+				certificates.UsageDigitalSignature,
+				certificates.UsageKeyEncipherment,
+				certificates.UsageClientAuth,
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CSR: %v", err)
+	}
+
+	certData, err := waitForCertificate(csrClient, csr.Name, stopCh)
+	if err != nil {
+		return nil, err
+	}
+
+	keyData, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal client key: %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyData})
+	if err := persistCert(m.certFile, m.keyFile, certData, keyPEM); err != nil {
+		return nil, err
+	}
+
+	cfg := m.baseCfg
+	cfg.TLSClientConfig.CertFile = m.certFile
+	cfg.TLSClientConfig.KeyFile = m.keyFile
+	cfg.TLSClientConfig.CertData = nil
+	cfg.TLSClientConfig.KeyData = nil
+	cfg.BearerToken = ""
+	cfg.Username = ""
+	cfg.Password = ""
+	return &cfg, nil
+}
+
+// runRotation renews the client certificate shortly before it expires, applying each renewed
+// config with apply (typically nodeProblemClient.setConfig), until stopCh is closed.
+func (m *certManager) runRotation(apply func(*restclient.Config) error, stopCh <-chan struct{}) {
+	for {
+		cert, err := tls.LoadX509KeyPair(m.certFile, m.keyFile)
+		renewAt := time.Now().Add(time.Hour)
+		if err == nil && len(cert.Certificate) > 0 {
+			if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+				renewAt = renewalTime(leaf, *certRenewalFraction)
+			}
+		}
+		if d := time.Until(renewAt); d > 0 {
+			select {
+			case <-time.After(d):
+			case <-stopCh:
+				return
+			}
+		}
+		cfg, err := m.bootstrap(stopCh)
+		if err != nil {
+			glog.Errorf("Failed to renew client certificate, will retry: %v", err)
+			select {
+			case <-time.After(time.Minute):
+			case <-stopCh:
+				return
+			}
+			continue
+		}
+		if err := apply(cfg); err != nil {
+			glog.Errorf("Failed to apply renewed client certificate: %v", err)
+		}
+		select {
+		case <-stopCh:
+			return
+		default:
+		}
+	}
+}
+
+// renewalTime returns the point in cert's validity window at which it should be renewed, i.e.
+// when only the given fraction of its validity period remains.
+func renewalTime(cert *x509.Certificate, fraction float64) time.Time {
+	validity := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotAfter.Add(-time.Duration(float64(validity) * fraction))
+}
+
+// newCertificateRequest generates a PEM-encoded CSR for the given node, with the CN/organization
+// kubelet itself uses so the result is authorized the same way: system:node:<name>/system:nodes.
+func newCertificateRequest(key *ecdsa.PrivateKey, nodeName string) ([]byte, error) {
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName:   "system:node:" + nodeName,
+			Organization: []string{"system:nodes"},
+		},
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate request: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// waitForCertificate polls the CSR until it has been approved and the signed certificate has
+// been populated, and returns the PEM-encoded certificate. It polls immediately, then on every
+// csrPollInterval tick, and gives up if csrPollTimeout elapses or stopCh is closed first, so a
+// Close() during the initial bootstrap or a later rotation doesn't have to wait out the full
+// timeout.
+func waitForCertificate(csrClient *unversionedcertificates.CertificatesClient, name string, stopCh <-chan struct{}) ([]byte, error) {
+	timeout := time.After(csrPollTimeout)
+	for {
+		cert, done, err := pollCSR(csrClient, name)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return cert, nil
+		}
+		select {
+		case <-time.After(csrPollInterval):
+		case <-timeout:
+			return nil, fmt.Errorf("timed out waiting for CSR %s to be approved", name)
+		case <-stopCh:
+			return nil, fmt.Errorf("stopped waiting for CSR %s to be approved", name)
+		}
+	}
+}
+
+// pollCSR fetches the current state of the named CSR. done is true once it has been approved and
+// its signed certificate is populated, in which case cert holds the PEM-encoded certificate.
+func pollCSR(csrClient *unversionedcertificates.CertificatesClient, name string) (cert []byte, done bool, err error) {
+	csr, err := csrClient.CertificateSigningRequests().Get(name)
+	if err != nil {
+		return nil, false, err
+	}
+	approved := false
+	for _, c := range csr.Status.Conditions {
+		if c.Type == certificates.CertificateApproved {
+			approved = true
+		}
+		if c.Type == certificates.CertificateDenied {
+			return nil, false, fmt.Errorf("CSR %s was denied: %s", name, c.Reason)
+		}
+	}
+	if approved && len(csr.Status.Certificate) > 0 {
+		return csr.Status.Certificate, true, nil
+	}
+	return nil, false, nil
+}
+
+// persistCert writes the client certificate and key to disk, creating certDir if necessary.
+func persistCert(certFile, keyFile string, certPEM, keyPEM []byte) error {
+	dir := filepath.Dir(certFile)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create cert directory %q: %v", dir, err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return fmt.Errorf("failed to write client key: %v", err)
+	}
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		return fmt.Errorf("failed to write client certificate: %v", err)
+	}
+	return nil
+}
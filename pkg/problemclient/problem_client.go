@@ -20,22 +20,88 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"math/rand"
 	"net"
 	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
 
 	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/errors"
 	"k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/client/cache"
 	"k8s.io/kubernetes/pkg/client/record"
 	"k8s.io/kubernetes/pkg/client/restclient"
 	client "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/client/unversioned/clientcmd"
+	clientcmdapi "k8s.io/kubernetes/pkg/client/unversioned/clientcmd/api"
+	"k8s.io/kubernetes/pkg/fields"
+	"k8s.io/kubernetes/pkg/runtime"
 	"k8s.io/kubernetes/pkg/types"
 	"k8s.io/kubernetes/pkg/util"
 	nodeutil "k8s.io/kubernetes/pkg/util/node"
+	"k8s.io/kubernetes/pkg/watch"
 )
 
 var (
 	hostnameOverride   = flag.String("hostname-override", "", "If non-empty, will use this string as identification instead of the actual hostname. Default: \"\". ")
 	insecureConnection = flag.Bool("insecure-connection", false, "If true, node problem detector will skip TLS verification while connecting with apiserver. Default: false.")
+	kubeconfig         = flag.String("kubeconfig", "", "Path to a kubeconfig file, specifying how to connect to the apiserver. If set, this takes precedence over --insecure-connection and in-cluster config, and allows node problem detector to run out of the cluster.")
+	kubeContext        = flag.String("kube-context", "", "The name of the kubeconfig context to use.")
+	kubeCluster        = flag.String("kube-cluster", "", "The name of the kubeconfig cluster to use.")
+	kubeUser           = flag.String("kube-user", "", "The name of the kubeconfig user to use.")
+	kubeServer         = flag.String("kube-apiserver", "", "The address of the Kubernetes API server, overriding the kubeconfig value.")
+	kubeCAFile         = flag.String("kube-certificate-authority", "", "Path to a cert file for the certificate authority, overriding the kubeconfig value.")
+	kubeToken          = flag.String("kube-token", "", "Bearer token for authentication to the apiserver, overriding the kubeconfig value.")
+	nodeCacheResync    = flag.Duration("node-cache-resync-period", 1*time.Minute, "The period at which the node informer cache resyncs with the apiserver.")
+	apiserverQPS       = flag.Float64("apiserver-qps", 0, "The QPS to use while talking with apiserver. If 0, the restclient default is used.")
+	apiserverBurst     = flag.Int("apiserver-burst", 0, "The burst to allow while talking with apiserver. If 0, the restclient default is used.")
+	eventQPS           = flag.Float64("event-apiserver-qps", 0, "The QPS to use while reporting events to apiserver. If 0, the restclient default is used.")
+	eventBurst         = flag.Int("event-apiserver-burst", 0, "The burst to allow while reporting events to apiserver. If 0, the restclient default is used.")
+	apiservers         apiserverFlag
+)
+
+func init() {
+	flag.Var(&apiservers, "apiserver", "The address of an apiserver endpoint. May be specified multiple times, or as a single comma-separated list, to enable failover across a multi-apiserver (e.g. HA) control plane. If unset, the host from --kubeconfig/in-cluster config is used.")
+}
+
+// apiserverFlag collects one or more apiserver addresses, either via repeated --apiserver flags
+// or a single comma-separated value.
+type apiserverFlag []string
+
+func (f *apiserverFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *apiserverFlag) Set(value string) error {
+	*f = append(*f, strings.Split(value, ",")...)
+	return nil
+}
+
+// setConditionsBackoff* parameterize the backoff policy used when retrying SetConditions against
+// the apiserver: it retries only on errors that look transient (5xx, timeouts, rate limiting, or a
+// net.Error), doubling the delay (plus jitter) after each attempt up to setConditionsBackoffCap,
+// and gives up after setConditionsBackoffSteps attempts rather than retrying forever.
+//
+// The retry loop is hand-rolled rather than built on wait.ExponentialBackoff/wait.Backoff.Cap: this
+// tree pins the pre-client-go wait package, and Cap was only added there well after this client
+// package's vintage, so a literal with a Cap field wouldn't compile against the real vendored type.
+//
+// Each of these steps is a full sweep of clientPool.do over every healthy apiserver endpoint (see
+// its doc comment), not a single request, so with N configured --apiserver endpoints a single
+// SetConditions call can issue up to setConditionsBackoffSteps*N requests in the worst case (all
+// endpoints failing). That's intentional: the delay between steps exists to space out sweeps so a
+// rolling apiserver upgrade has time to bring an endpoint back, while clientPool.do's per-sweep
+// failover exists to avoid waiting on a single down endpoint within a sweep.
+const (
+	setConditionsBackoffSteps    = 5
+	setConditionsBackoffDuration = 500 * time.Millisecond
+	setConditionsBackoffFactor   = 2.0
+	setConditionsBackoffJitter   = 0.1
+	setConditionsBackoffCap      = 30 * time.Second
 )
 
 // Client is the interface of problem client
@@ -46,42 +112,304 @@ type Client interface {
 	SetConditions(conditions []api.NodeCondition) error
 	// Eventf reports the event.
 	Eventf(eventType string, source, reason, messageFmt string, args ...interface{})
+	// Close closes the problem client, releasing any resources held (e.g. the node cache
+	// reflector and, if bootstrap TLS is enabled, the cert rotation goroutine).
+	Close()
 }
 
 type nodeProblemClient struct {
-	nodeName  string
-	client    *client.Client
-	clock     util.Clock
-	recorders map[string]record.EventRecorder
-	nodeRef   *api.ObjectReference
+	nodeName string
+	// clientMu guards client/eventClient, which are swapped wholesale when the bootstrap CSR
+	// rotation goroutine obtains a renewed client certificate.
+	clientMu    sync.RWMutex
+	client      *clientPool
+	eventClient *clientPool
+	hosts       []string
+	clock       util.Clock
+	recorders   map[string]record.EventRecorder
+	nodeRef     *api.ObjectReference
+	nodeStore   cache.Store
+	stopCh      chan struct{}
+	// rotationStopCh stops the bootstrap cert rotation goroutine, if one was started.
+	rotationStopCh chan struct{}
 }
 
 // NewClientOrDie creates a new problem client, panics if error occurs.
 func NewClientOrDie() Client {
 	c := &nodeProblemClient{clock: util.RealClock{}}
-	var cfg *restclient.Config
-	if !*insecureConnection {
-		var err error
-		cfg, err = restclient.InClusterConfig()
+	c.nodeName = nodeutil.GetHostname(*hostnameOverride)
+
+	// buildConfig may legitimately fail here when --bootstrap-kubeconfig is the only credential
+	// a fresh node has (no --kubeconfig, not in-cluster yet): in that case cfgErr is non-fatal,
+	// and maybeNewCertManager falls back to deriving the base cluster info from the bootstrap
+	// kubeconfig itself.
+	cfg, cfgErr := buildConfig()
+	if cfgErr != nil {
+		cfg = nil
+	}
+	certMgr, err := maybeNewCertManager(cfg, c.nodeName)
+	if err != nil {
+		panic(err)
+	}
+	if certMgr != nil {
+		c.rotationStopCh = make(chan struct{})
+		cfg, err = certMgr.bootstrap(c.rotationStopCh)
 		if err != nil {
 			panic(err)
 		}
-	} else {
-		cfg = &restclient.Config{
-			Host:     getClusterHostOrDie(),
-			Insecure: true,
-		}
+	} else if cfgErr != nil {
+		panic(cfgErr)
 	}
-	// TODO(random-liu): Set QPS Limit
-	c.client = client.NewOrDie(cfg)
-	c.nodeName = nodeutil.GetHostname(*hostnameOverride)
+	c.hosts = apiserverHosts(cfg)
+	if err := c.setConfig(cfg); err != nil {
+		panic(err)
+	}
+
 	c.nodeRef = getNodeRef(c.nodeName)
 	c.recorders = make(map[string]record.EventRecorder)
+	c.nodeStore, c.stopCh = newNodeStore(c)
+	if certMgr != nil {
+		go certMgr.runRotation(c.setConfig, c.rotationStopCh)
+	}
 	return c
 }
 
+// setConfig (re)builds the client and event client pools from cfg, for c.hosts. It is called
+// once at startup and again by the bootstrap rotation goroutine whenever it renews the client
+// certificate, swapping the pools under clientMu so in-flight SetConditions/GetConditions/Eventf
+// callers always see a consistent, usable pool. It always (re)applies --apiserver-qps/--apiserver-burst
+// (and the event equivalents) itself, rather than trusting cfg to already carry them, since cfg may
+// be a bootstrap-rebuilt config (e.g. from certManager.bootstrap()) that predates those flags being set.
+func (c *nodeProblemClient) setConfig(cfg *restclient.Config) error {
+	cfg.QPS = float32(*apiserverQPS)
+	cfg.Burst = *apiserverBurst
+	pool, err := newClientPool(cfg, c.hosts)
+	if err != nil {
+		return err
+	}
+	eventCfg := *cfg
+	eventCfg.QPS = float32(*eventQPS)
+	eventCfg.Burst = *eventBurst
+	eventPool, err := newClientPool(&eventCfg, c.hosts)
+	if err != nil {
+		return err
+	}
+	c.clientMu.Lock()
+	defer c.clientMu.Unlock()
+	c.client = pool
+	c.eventClient = eventPool
+	return nil
+}
+
+func (c *nodeProblemClient) clientPool() *clientPool {
+	c.clientMu.RLock()
+	defer c.clientMu.RUnlock()
+	return c.client
+}
+
+func (c *nodeProblemClient) eventClientPool() *clientPool {
+	c.clientMu.RLock()
+	defer c.clientMu.RUnlock()
+	return c.eventClient
+}
+
+// apiserverHosts returns the set of apiserver endpoints the client pool should maintain. If
+// --apiserver was given, that list is used (enabling failover); otherwise we fall back to
+// today's single-endpoint behavior, using whatever host buildConfig() resolved (in-cluster VIP,
+// --insecure-connection host, or the kubeconfig's host).
+func apiserverHosts(cfg *restclient.Config) []string {
+	if len(apiservers) > 0 {
+		return []string(apiservers)
+	}
+	return []string{cfg.Host}
+}
+
+// newNodeStore starts a reflector which watches only the current node, and returns a local
+// store kept in sync with the apiserver, along with the stop channel that controls it. The
+// ListFunc/WatchFunc below resolve the client pool at call time, rather than capturing one
+// client up front, so that every (re)connect the reflector makes transparently picks up a
+// rotated client certificate and fails over to the next healthy apiserver endpoint.
+func newNodeStore(c *nodeProblemClient) (cache.Store, chan struct{}) {
+	selector := fields.OneTermEqualSelector("metadata.name", c.nodeName)
+	lw := &cache.ListWatch{
+		ListFunc: func(options api.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			return c.clientPool().any().Nodes().List(options)
+		},
+		WatchFunc: func(options api.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			return c.clientPool().any().Nodes().Watch(options)
+		},
+	}
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	reflector := cache.NewReflector(lw, &api.Node{}, store, *nodeCacheResync)
+	stopCh := make(chan struct{})
+	reflector.RunUntil(stopCh)
+	return store, stopCh
+}
+
+// buildConfig builds the rest client config node problem detector connects to the apiserver with.
+// The precedence, from highest to lowest, is --kubeconfig, --insecure-connection, in-cluster config.
+func buildConfig() (*restclient.Config, error) {
+	if *kubeconfig != "" {
+		rules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: *kubeconfig}
+		overrides := &clientcmd.ConfigOverrides{
+			Context: clientcmdapi.Context{
+				Cluster:  *kubeCluster,
+				AuthInfo: *kubeUser,
+			},
+			CurrentContext: *kubeContext,
+			ClusterInfo: clientcmdapi.Cluster{
+				Server:                *kubeServer,
+				CertificateAuthority:  *kubeCAFile,
+				InsecureSkipTLSVerify: *insecureConnection,
+			},
+			AuthInfo: clientcmdapi.AuthInfo{
+				Token: *kubeToken,
+			},
+		}
+		return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	}
+	if *insecureConnection {
+		return &restclient.Config{
+			Host:     getClusterHostOrDie(),
+			Insecure: true,
+		}, nil
+	}
+	return restclient.InClusterConfig()
+}
+
+// urlBackoff tracks a simple exponential backoff penalty per apiserver host, similar in spirit
+// to restclient/urlbackoff: each failure doubles the penalty (capped), and a success clears it.
+type urlBackoff struct {
+	mu      sync.Mutex
+	until   map[string]time.Time
+	penalty map[string]time.Duration
+}
+
+const (
+	urlBackoffBase = 1 * time.Second
+	urlBackoffCap  = 60 * time.Second
+)
+
+func newURLBackoff() *urlBackoff {
+	return &urlBackoff{until: make(map[string]time.Time), penalty: make(map[string]time.Duration)}
+}
+
+func (b *urlBackoff) isHealthy(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	until, ok := b.until[host]
+	return !ok || !time.Now().Before(until)
+}
+
+func (b *urlBackoff) onSuccess(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.until, host)
+	delete(b.penalty, host)
+}
+
+func (b *urlBackoff) onFailure(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	penalty := b.penalty[host] * 2
+	if penalty < urlBackoffBase {
+		penalty = urlBackoffBase
+	}
+	if penalty > urlBackoffCap {
+		penalty = urlBackoffCap
+	}
+	b.penalty[host] = penalty
+	b.until[host] = time.Now().Add(penalty)
+}
+
+// clientPool maintains a round-robin pool of clients, one per apiserver endpoint, and the
+// per-host backoff state used to skip endpoints that have been failing.
+type clientPool struct {
+	mu      sync.Mutex
+	hosts   []string
+	clients map[string]*client.Client
+	next    int
+	backoff *urlBackoff
+}
+
+// newClientPool creates a clientPool for the given hosts, all sharing cfg's auth/TLS settings.
+func newClientPool(cfg *restclient.Config, hosts []string) (*clientPool, error) {
+	pool := &clientPool{clients: make(map[string]*client.Client), backoff: newURLBackoff()}
+	for _, host := range hosts {
+		hostCfg := *cfg
+		hostCfg.Host = host
+		c, err := client.New(&hostCfg)
+		if err != nil {
+			return nil, err
+		}
+		pool.hosts = append(pool.hosts, host)
+		pool.clients[host] = c
+	}
+	return pool, nil
+}
+
+// order returns the pool's hosts starting from the next round-robin position.
+func (p *clientPool) order() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	start := p.next % len(p.hosts)
+	p.next++
+	ordered := make([]string, 0, len(p.hosts))
+	ordered = append(ordered, p.hosts[start:]...)
+	ordered = append(ordered, p.hosts[:start]...)
+	return ordered
+}
+
+// do calls fn with each client in round-robin order, skipping hosts currently in backoff, until
+// fn succeeds or every host has been tried (i.e. up to one request per host in the pool). It
+// transparently fails over to the next healthy apiserver endpoint, which is what lets
+// SetConditions/GetConditions/Eventf ride out a rolling apiserver upgrade where a single endpoint
+// may be unavailable for a while. Note that callers layering their own retry loop on top of do
+// (e.g. SetConditions's setConditionsBackoff) compound with this per-sweep failover: each retry
+// of the outer loop is itself a full sweep over every healthy host, not a single request.
+func (p *clientPool) do(fn func(c *client.Client) error) error {
+	var lastErr error
+	tried := false
+	for _, host := range p.order() {
+		if !p.backoff.isHealthy(host) {
+			continue
+		}
+		tried = true
+		lastErr = fn(p.clients[host])
+		if lastErr == nil {
+			p.backoff.onSuccess(host)
+			return nil
+		}
+		p.backoff.onFailure(host)
+	}
+	if !tried {
+		// Every host is in backoff; try the first one anyway rather than failing outright.
+		host := p.hosts[0]
+		lastErr = fn(p.clients[host])
+		if lastErr == nil {
+			p.backoff.onSuccess(host)
+		} else {
+			p.backoff.onFailure(host)
+		}
+	}
+	return lastErr
+}
+
+// any returns one client from the pool, preferring a healthy host. Used where only a single
+// long-lived connection is needed (e.g. the node informer's list and watch).
+func (p *clientPool) any() *client.Client {
+	for _, host := range p.order() {
+		if p.backoff.isHealthy(host) {
+			return p.clients[host]
+		}
+	}
+	return p.clients[p.hosts[0]]
+}
+
 func (c *nodeProblemClient) GetConditions(conditionTypes []api.NodeConditionType) ([]*api.NodeCondition, error) {
-	node, err := c.client.Nodes().Get(c.nodeName)
+	node, err := c.getNode()
 	if err != nil {
 		return nil, err
 	}
@@ -103,16 +431,89 @@ func (c *nodeProblemClient) SetConditions(newConditions []api.NodeCondition) err
 	}
 	patch, err := generatePatch(newConditions)
 	if err != nil {
-		return nil
+		return err
+	}
+	var lastErr error
+	delay := time.Duration(setConditionsBackoffDuration)
+	for step := 0; step < setConditionsBackoffSteps; step++ {
+		lastErr = c.clientPool().do(func(cli *client.Client) error {
+			return cli.Patch(api.StrategicMergePatchType).Resource("nodes").Name(c.nodeName).SubResource("status").Body(patch).Do().Error()
+		})
+		if lastErr == nil {
+			return nil
+		}
+		if !isRetriableError(lastErr) {
+			glog.Errorf("Not retrying non-retriable error setting node conditions: %v", lastErr)
+			return lastErr
+		}
+		if step == setConditionsBackoffSteps-1 {
+			break
+		}
+		glog.Warningf("Retrying after error setting node conditions: %v", lastErr)
+		time.Sleep(jitter(delay, setConditionsBackoffJitter))
+		if delay = time.Duration(float64(delay) * setConditionsBackoffFactor); delay > setConditionsBackoffCap {
+			delay = setConditionsBackoffCap
+		}
+	}
+	return lastErr
+}
+
+// jitter returns d plus up to maxFactor*d of additional random delay, the same shape as
+// wait.Jitter, so retries across multiple node-problem-detector instances don't all land on the
+// apiserver in lockstep.
+func jitter(d time.Duration, maxFactor float64) time.Duration {
+	if maxFactor <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Float64()*maxFactor*float64(d))
+}
+
+// isRetriableError returns true for errors that are likely transient apiserver issues: 5xx
+// responses, server timeouts, rate limiting, or network-level errors.
+func isRetriableError(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	if errors.IsServerTimeout(err) || errors.IsTooManyRequests(err) {
+		return true
+	}
+	if status, ok := err.(errors.APIStatus); ok {
+		return status.Status().Code >= 500
+	}
+	return false
+}
+
+// getNode returns the current node, reading from the local informer cache when possible and
+// falling back to a direct Get when the cache has not synced yet.
+func (c *nodeProblemClient) getNode() (*api.Node, error) {
+	if c.nodeStore != nil {
+		obj, exists, err := c.nodeStore.GetByKey(c.nodeName)
+		if err == nil && exists {
+			return obj.(*api.Node), nil
+		}
+	}
+	var node *api.Node
+	err := c.clientPool().do(func(cli *client.Client) error {
+		var err error
+		node, err = cli.Nodes().Get(c.nodeName)
+		return err
+	})
+	return node, err
+}
+
+func (c *nodeProblemClient) Close() {
+	if c.stopCh != nil {
+		close(c.stopCh)
+	}
+	if c.rotationStopCh != nil {
+		close(c.rotationStopCh)
 	}
-	return c.client.Patch(api.StrategicMergePatchType).Resource("nodes").Name(c.nodeName).SubResource("status").Body(patch).Do().Error()
 }
 
 func (c *nodeProblemClient) Eventf(eventType, source, reason, messageFmt string, args ...interface{}) {
 	recorder, found := c.recorders[source]
 	if !found {
-		// TODO(random-liu): If needed use separate client and QPS limit for event.
-		recorder = getEventRecorder(c.client, c.nodeName, source)
+		recorder = getEventRecorder(c, source)
 		c.recorders[source] = recorder
 	}
 	recorder.Eventf(c.nodeRef, eventType, reason, messageFmt, args...)
@@ -127,14 +528,54 @@ func generatePatch(conditions []api.NodeCondition) ([]byte, error) {
 	return []byte(fmt.Sprintf(`{"status":{"conditions":%s}}`, raw)), nil
 }
 
-// getEventRecorder generates a recorder for specific node name and source.
-func getEventRecorder(c *client.Client, nodeName, source string) record.EventRecorder {
+// getEventRecorder generates a recorder for specific node name and source. The recorder is
+// backed by a pooledEventSink rather than a specific client, so it keeps working across client
+// pool swaps (cert rotation) and apiserver endpoint failover without ever needing to be rebuilt.
+func getEventRecorder(c *nodeProblemClient, source string) record.EventRecorder {
 	eventBroadcaster := record.NewBroadcaster()
-	recorder := eventBroadcaster.NewRecorder(api.EventSource{Component: source, Host: nodeName})
-	eventBroadcaster.StartRecordingToSink(c.Events(""))
+	recorder := eventBroadcaster.NewRecorder(api.EventSource{Component: source, Host: c.nodeName})
+	eventBroadcaster.StartRecordingToSink(&pooledEventSink{client: c})
 	return recorder
 }
 
+// pooledEventSink implements record.EventSink by resolving the live event client pool on every
+// call (via nodeProblemClient.eventClientPool) and routing the request through clientPool.do, so
+// event reporting transparently fails over to the next healthy apiserver endpoint and survives
+// the event client pool being swapped out from under it by cert rotation.
+type pooledEventSink struct {
+	client *nodeProblemClient
+}
+
+func (s *pooledEventSink) Create(event *api.Event) (*api.Event, error) {
+	var result *api.Event
+	err := s.client.eventClientPool().do(func(cli *client.Client) error {
+		var err error
+		result, err = cli.Events("").Create(event)
+		return err
+	})
+	return result, err
+}
+
+func (s *pooledEventSink) Update(event *api.Event) (*api.Event, error) {
+	var result *api.Event
+	err := s.client.eventClientPool().do(func(cli *client.Client) error {
+		var err error
+		result, err = cli.Events("").Update(event)
+		return err
+	})
+	return result, err
+}
+
+func (s *pooledEventSink) Patch(event *api.Event, data []byte) (*api.Event, error) {
+	var result *api.Event
+	err := s.client.eventClientPool().do(func(cli *client.Client) error {
+		var err error
+		result, err = cli.Events("").Patch(event, data)
+		return err
+	})
+	return result, err
+}
+
 func getNodeRef(nodeName string) *api.ObjectReference {
 	// TODO(random-liu): Get node to initalize the node reference
 	return &api.ObjectReference{
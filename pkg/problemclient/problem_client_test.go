@@ -0,0 +1,267 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package problemclient
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/client/restclient"
+	client "k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+// resetFlags restores the package's global flag variables after a test mutates them, so tests
+// can run in any order without leaking state into each other.
+func resetFlags() {
+	*kubeconfig = ""
+	*insecureConnection = false
+	*kubeContext = ""
+	*kubeCluster = ""
+	*kubeUser = ""
+	*kubeServer = ""
+	*kubeCAFile = ""
+	*kubeToken = ""
+}
+
+const testKubeconfig = `
+apiVersion: v1
+kind: Config
+clusters:
+- name: test-cluster
+  cluster:
+    server: https://kubeconfig-host:6443
+contexts:
+- name: test-context
+  context:
+    cluster: test-cluster
+    user: test-user
+current-context: test-context
+users:
+- name: test-user
+  user:
+    token: test-token
+`
+
+func TestBuildConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "problemclient-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	kubeconfigPath := filepath.Join(dir, "kubeconfig")
+	if err := ioutil.WriteFile(kubeconfigPath, []byte(testKubeconfig), 0644); err != nil {
+		t.Fatalf("failed to write test kubeconfig: %v", err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		setup    func()
+		wantHost string
+		wantErr  bool
+	}{
+		{
+			name: "kubeconfig takes precedence over insecure-connection",
+			setup: func() {
+				*kubeconfig = kubeconfigPath
+				*insecureConnection = true
+			},
+			wantHost: "https://kubeconfig-host:6443",
+		},
+		{
+			name: "kubeconfig overrides honored",
+			setup: func() {
+				*kubeconfig = kubeconfigPath
+				*kubeServer = "https://overridden-host:6443"
+			},
+			wantHost: "https://overridden-host:6443",
+		},
+		{
+			name: "insecure-connection used when no kubeconfig",
+			setup: func() {
+				os.Setenv("KUBERNETES_SERVICE_HOST", "1.2.3.4")
+				os.Setenv("KUBERNETES_SERVICE_PORT", "443")
+				*insecureConnection = true
+			},
+			wantHost: "https://1.2.3.4:443",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resetFlags()
+			test.setup()
+			defer os.Unsetenv("KUBERNETES_SERVICE_HOST")
+			defer os.Unsetenv("KUBERNETES_SERVICE_PORT")
+
+			cfg, err := buildConfig()
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cfg.Host != test.wantHost {
+				t.Errorf("got host %q, want %q", cfg.Host, test.wantHost)
+			}
+		})
+	}
+	resetFlags()
+}
+
+func TestBuildConfigInClusterFallback(t *testing.T) {
+	resetFlags()
+	os.Unsetenv("KUBERNETES_SERVICE_HOST")
+	os.Unsetenv("KUBERNETES_SERVICE_PORT")
+
+	if _, err := buildConfig(); err == nil {
+		t.Errorf("expected an error falling back to in-cluster config outside a cluster, got none")
+	}
+}
+
+type fakeNetError struct{}
+
+func (fakeNetError) Error() string   { return "fake net error" }
+func (fakeNetError) Timeout() bool   { return true }
+func (fakeNetError) Temporary() bool { return true }
+
+var _ net.Error = fakeNetError{}
+
+func TestIsRetriableError(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil is not retriable", err: nil, want: false},
+		{name: "net.Error is retriable", err: fakeNetError{}, want: true},
+		{name: "server timeout is retriable", err: apierrors.NewServerTimeout(unversioned.GroupResource{Resource: "nodes"}, "patch", 0), want: true},
+		{name: "too many requests is retriable", err: apierrors.NewTooManyRequests("retry later", 1), want: true},
+		{name: "internal server error is retriable", err: apierrors.NewInternalError(fmt.Errorf("boom")), want: true},
+		{name: "not found is not retriable", err: apierrors.NewNotFound(unversioned.GroupResource{Resource: "nodes"}, "node"), want: false},
+		{name: "generic error is not retriable", err: errors.New("some error"), want: false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isRetriableError(test.err); got != test.want {
+				t.Errorf("isRetriableError(%v) = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestURLBackoff(t *testing.T) {
+	b := newURLBackoff()
+	host := "https://apiserver-1:6443"
+
+	if !b.isHealthy(host) {
+		t.Fatalf("host should start healthy")
+	}
+
+	b.onFailure(host)
+	if b.isHealthy(host) {
+		t.Fatalf("host should be unhealthy immediately after a failure")
+	}
+	if got, want := b.penalty[host], urlBackoffBase; got != want {
+		t.Errorf("first penalty = %v, want %v", got, want)
+	}
+
+	b.until[host] = time.Now().Add(-time.Second) // force the penalty to have elapsed
+	if !b.isHealthy(host) {
+		t.Fatalf("host should be healthy again once its penalty has elapsed")
+	}
+
+	// Repeated failures should double the penalty, up to the cap.
+	for i := 0; i < 10; i++ {
+		b.onFailure(host)
+	}
+	if got, want := b.penalty[host], urlBackoffCap; got != want {
+		t.Errorf("penalty after repeated failures = %v, want cap %v", got, want)
+	}
+
+	b.onSuccess(host)
+	if !b.isHealthy(host) {
+		t.Errorf("host should be healthy immediately after a success")
+	}
+	if _, ok := b.penalty[host]; ok {
+		t.Errorf("penalty should be cleared after a success")
+	}
+}
+
+func TestClientPoolDoFailsOverToNextHealthyHost(t *testing.T) {
+	hosts := []string{"https://apiserver-1:6443", "https://apiserver-2:6443", "https://apiserver-3:6443"}
+	pool, err := newClientPool(&restclient.Config{}, hosts)
+	if err != nil {
+		t.Fatalf("failed to create client pool: %v", err)
+	}
+
+	err = pool.do(func(_ *client.Client) error {
+		return errors.New("boom")
+	})
+	if err == nil {
+		t.Fatalf("expected an error when every call fails")
+	}
+
+	callCount := 0
+	err = pool.do(func(_ *client.Client) error {
+		callCount++
+		if callCount < 2 {
+			return errors.New("endpoint down")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected do() to succeed once a healthy host is reached, got: %v", err)
+	}
+	if callCount != 2 {
+		t.Errorf("expected do() to try 2 hosts before succeeding, tried %d", callCount)
+	}
+}
+
+func TestClientPoolOrderRoundRobins(t *testing.T) {
+	hosts := []string{"https://apiserver-1:6443", "https://apiserver-2:6443", "https://apiserver-3:6443"}
+	pool, err := newClientPool(&restclient.Config{}, hosts)
+	if err != nil {
+		t.Fatalf("failed to create client pool: %v", err)
+	}
+
+	first := pool.order()
+	second := pool.order()
+	if first[0] == second[0] {
+		t.Errorf("expected order() to rotate the starting host between calls, got %v then %v", first, second)
+	}
+}
+
+func TestRenewalTime(t *testing.T) {
+	notBefore := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := notBefore.Add(100 * time.Hour)
+	cert := &x509.Certificate{NotBefore: notBefore, NotAfter: notAfter}
+
+	got := renewalTime(cert, 0.2)
+	want := notAfter.Add(-20 * time.Hour)
+	if !got.Equal(want) {
+		t.Errorf("renewalTime() = %v, want %v", got, want)
+	}
+}